@@ -0,0 +1,66 @@
+package astikit
+
+import "sync"
+
+// GoroutineLimiterOptions are GoroutineLimiter options
+type GoroutineLimiterOptions struct {
+	// Max is the maximum number of goroutines allowed to run concurrently. A value <= 0
+	// means no limit is enforced.
+	Max int
+}
+
+// GoroutineLimiter executes functions in their own goroutine while making sure no more than
+// Max of them run at the same time.
+type GoroutineLimiter struct {
+	c    chan bool
+	errs []error
+	mu   sync.Mutex
+	wg   sync.WaitGroup
+}
+
+// NewGoroutineLimiter creates a new GoroutineLimiter
+func NewGoroutineLimiter(o GoroutineLimiterOptions) (l *GoroutineLimiter) {
+	l = &GoroutineLimiter{}
+	if o.Max > 0 {
+		l.c = make(chan bool, o.Max)
+	}
+	return
+}
+
+// Do executes f in a new goroutine, blocking until a slot is available if Max has been reached.
+// If f returns an error, it's stored and will be returned by the next call to Wait.
+func (l *GoroutineLimiter) Do(f func() error) {
+	l.wg.Add(1)
+	if l.c != nil {
+		l.c <- true
+	}
+	go func() {
+		defer l.wg.Done()
+		if l.c != nil {
+			defer func() { <-l.c }()
+		}
+		if err := f(); err != nil {
+			l.mu.Lock()
+			l.errs = append(l.errs, err)
+			l.mu.Unlock()
+		}
+	}()
+}
+
+// Wait blocks until every goroutine submitted through Do so far has finished, and returns the
+// first error encountered, if any. The limiter is left ready for reuse: errors from this batch
+// don't leak into the result of a later Wait.
+func (l *GoroutineLimiter) Wait() error {
+	l.wg.Wait()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var err error
+	if len(l.errs) > 0 {
+		err = l.errs[0]
+	}
+	l.errs = nil
+	return err
+}
+
+// Close closes the limiter
+func (l *GoroutineLimiter) Close() {}
@@ -0,0 +1,24 @@
+package astikit
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGoroutineLimiter(t *testing.T) {
+	l := NewGoroutineLimiter(GoroutineLimiterOptions{Max: 2})
+	defer l.Close()
+
+	// A failing batch returns its error
+	l.Do(func() error { return errors.New("oops") })
+	if err := l.Wait(); err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	// A later, all-success batch on the same limiter isn't poisoned by the earlier failure
+	l.Do(func() error { return nil })
+	l.Do(func() error { return nil })
+	if err := l.Wait(); err != nil {
+		t.Errorf("expected no error, got %+v", err)
+	}
+}
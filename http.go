@@ -0,0 +1,1134 @@
+package astikit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ServeHTTPOptions are ServeHTTP options
+type ServeHTTPOptions struct {
+	Addr    string
+	Handler http.Handler
+
+	// BaseContext is passed through to http.Server.BaseContext. Defaults to a context derived
+	// from the worker, so handlers can observe the worker being stopped through
+	// req.Context().Done() instead of relying on a sleep.
+	BaseContext func(net.Listener) context.Context
+
+	// ConnContext is passed through to http.Server.ConnContext
+	ConnContext func(ctx context.Context, c net.Conn) context.Context
+
+	// ShutdownTimeout bounds how long Shutdown is given to drain in-flight requests once the
+	// worker is stopped; Close is used if it's exceeded. Defaults to 5s. Ignored if
+	// ShutdownContext is set.
+	ShutdownTimeout time.Duration
+
+	// ShutdownContext, when set, builds the context passed to Shutdown, overriding
+	// ShutdownTimeout.
+	ShutdownContext func() context.Context
+
+	// PreShutdown, when set, is called synchronously right before Shutdown is invoked, e.g. to
+	// flip a readiness endpoint to unhealthy.
+	PreShutdown func()
+
+	// PostShutdown, when set, is called once shutdown has completed, with any error returned
+	// by Shutdown (nil on a clean graceful shutdown, the Shutdown error otherwise, even though
+	// Close was then used to force it).
+	PostShutdown func(err error)
+}
+
+// ServeHTTP serves o.Handler on o.Addr until w is stopped, at which point it gracefully drains
+// in-flight requests (bounded by o.ShutdownTimeout / o.ShutdownContext) before returning control
+// to w.Wait(). The listener is bound synchronously, so once ServeHTTP returns, connections to
+// o.Addr are guaranteed to reach the server.
+func ServeHTTP(w *Worker, o ServeHTTPOptions) (err error) {
+	srv := &http.Server{Addr: o.Addr, Handler: o.Handler}
+	if o.BaseContext != nil {
+		srv.BaseContext = o.BaseContext
+	} else {
+		srv.BaseContext = func(net.Listener) context.Context { return w.Context() }
+	}
+	if o.ConnContext != nil {
+		srv.ConnContext = o.ConnContext
+	}
+
+	ln, err := net.Listen("tcp", o.Addr)
+	if err != nil {
+		err = fmt.Errorf("astikit: listening on %s failed: %w", o.Addr, err)
+		return
+	}
+
+	serveTask := w.NewTask()
+	go func() {
+		defer serveTask.Done()
+		srv.Serve(ln)
+	}()
+
+	shutdownTask := w.NewTask()
+	go func() {
+		defer shutdownTask.Done()
+		<-w.Context().Done()
+
+		if o.PreShutdown != nil {
+			o.PreShutdown()
+		}
+
+		ctx := o.ShutdownContext
+		var shutdownCtx context.Context
+		var cancel context.CancelFunc
+		if ctx != nil {
+			shutdownCtx = ctx()
+		} else {
+			timeout := o.ShutdownTimeout
+			if timeout <= 0 {
+				timeout = 5 * time.Second
+			}
+			shutdownCtx, cancel = context.WithTimeout(context.Background(), timeout)
+		}
+		if cancel != nil {
+			defer cancel()
+		}
+
+		err := srv.Shutdown(shutdownCtx)
+		if err != nil {
+			srv.Close()
+		}
+
+		if o.PostShutdown != nil {
+			o.PostShutdown(err)
+		}
+	}()
+	return
+}
+
+// HTTPClient is a client capable of sending an *http.Request and returning an *http.Response.
+// http.Client satisfies this interface, which makes it easy to mock in tests.
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// HTTPSenderOptions are HTTPSender options
+type HTTPSenderOptions struct {
+	// Client is the HTTPClient used to send requests. Defaults to &http.Client{}.
+	Client HTTPClient
+
+	// RetryMax is the maximum number of retries allowed after the initial attempt.
+	RetryMax int
+
+	// RetryPolicy decides whether and after how long to retry a given attempt. Defaults to a
+	// ConstantBackoff built from RetryCooldown. Tests can set this to a deterministic
+	// RetryPolicy to avoid relying on real sleeps.
+	RetryPolicy RetryPolicy
+
+	// RetryCooldown is the cooldown used to build the default ConstantBackoff RetryPolicy
+	// when RetryPolicy isn't set. Defaults to 100ms.
+	RetryCooldown time.Duration
+}
+
+// HTTPSender sends *http.Request, retrying according to its RetryPolicy.
+type HTTPSender struct {
+	o HTTPSenderOptions
+}
+
+// NewHTTPSender creates a new HTTPSender
+func NewHTTPSender(o HTTPSenderOptions) *HTTPSender {
+	if o.Client == nil {
+		o.Client = &http.Client{}
+	}
+	if o.RetryPolicy == nil {
+		if o.RetryCooldown <= 0 {
+			o.RetryCooldown = 100 * time.Millisecond
+		}
+		o.RetryPolicy = ConstantBackoff{Cooldown: o.RetryCooldown}
+	}
+	return &HTTPSender{o: o}
+}
+
+// Send sends req, retrying according to its RetryPolicy up to RetryMax times.
+func (s *HTTPSender) Send(req *http.Request) (resp *http.Response, err error) {
+	for attempt := 0; ; attempt++ {
+		resp, err = s.o.Client.Do(req)
+
+		delay, retry := s.o.RetryPolicy.Next(attempt, req, resp, err)
+		if !retry {
+			return
+		}
+
+		if attempt >= s.o.RetryMax {
+			if err == nil {
+				err = fmt.Errorf("astikit: sending request failed with status code %d after %d attempt(s)", resp.StatusCode, attempt+1)
+			}
+			return
+		}
+
+		if fn, ok := req.Context().Value(httpSenderRetryObserverKey{}).(func(attempt int, resp *http.Response, err error)); ok {
+			fn(attempt, resp, err)
+		}
+
+		time.Sleep(delay)
+	}
+}
+
+// httpSenderRetryObserverKey is the context key WithHTTPSenderRetryObserver stores its callback
+// under.
+type httpSenderRetryObserverKey struct{}
+
+// WithHTTPSenderRetryObserver returns a copy of ctx under which HTTPSender.Send will call fn just
+// before sleeping for a retry of a request built from that context, in the same spirit as
+// net/http/httptrace.
+func WithHTTPSenderRetryObserver(ctx context.Context, fn func(attempt int, resp *http.Response, err error)) context.Context {
+	return context.WithValue(ctx, httpSenderRetryObserverKey{}, fn)
+}
+
+// TransientError wraps an error to mark it as transient, so that IsTransient reports true for it
+// even though it isn't otherwise recognized as such (e.g. an error from a custom HTTPClient).
+type TransientError struct{ Err error }
+
+// NewTransientError wraps err so that IsTransient(err) returns true. Returns nil if err is nil.
+func NewTransientError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &TransientError{Err: err}
+}
+
+// Error implements the error interface
+func (e *TransientError) Error() string { return e.Err.Error() }
+
+// Unwrap allows errors.Is/errors.As to see through TransientError
+func (e *TransientError) Unwrap() error { return e.Err }
+
+// IsTransient reports whether err is classified as transient: either explicitly wrapped with
+// NewTransientError, or matching one of the well-known transient conditions (a temporary
+// net.Error, a context deadline, or an unexpected EOF while reading a body).
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	var te *TransientError
+	if errors.As(err, &te) {
+		return true
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return ne.Temporary()
+	}
+	return false
+}
+
+// isRetryableStatusCode reports whether status is, by default, worth retrying: 429 Too Many
+// Requests, or any 5xx.
+func isRetryableStatusCode(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// defaultRetryable is the shared transient-error/status-code classification used by every
+// built-in RetryPolicy.
+func defaultRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return IsTransient(err)
+	}
+	return isRetryableStatusCode(resp.StatusCode)
+}
+
+// retryAfterDelay parses resp's Retry-After header, in either its delta-seconds or HTTP-date
+// form, returning ok == false if it's absent or unparsable.
+func retryAfterDelay(resp *http.Response) (delay time.Duration, ok bool) {
+	if resp == nil {
+		return 0, false
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// RetryPolicy decides, after a given attempt, whether HTTPSender should retry and how long it
+// should wait before doing so. attempt is 0-indexed (0 being the first attempt). resp is nil if
+// err is set.
+type RetryPolicy interface {
+	Next(attempt int, req *http.Request, resp *http.Response, err error) (delay time.Duration, retry bool)
+}
+
+// ConstantBackoff is a RetryPolicy waiting for a fixed Cooldown between every retry, unless the
+// response carries a Retry-After header, which then sets the delay. This is HTTPSender's
+// historical behavior.
+type ConstantBackoff struct{ Cooldown time.Duration }
+
+// Next implements the RetryPolicy interface
+func (p ConstantBackoff) Next(attempt int, req *http.Request, resp *http.Response, err error) (delay time.Duration, retry bool) {
+	if !defaultRetryable(resp, err) {
+		return 0, false
+	}
+	delay = p.Cooldown
+	if d, ok := retryAfterDelay(resp); ok {
+		delay = d
+	}
+	return delay, true
+}
+
+// ExponentialBackoff is a RetryPolicy doubling its delay on every attempt, up to Max, and
+// randomizing it by up to JitterFraction in either direction, i.e.
+// min(Max, Base*2^attempt) * (1 ± rand*JitterFraction). A Retry-After header on the response
+// overrides that computed delay.
+type ExponentialBackoff struct {
+	Base           time.Duration
+	Max            time.Duration
+	JitterFraction float64
+}
+
+// Next implements the RetryPolicy interface
+func (p ExponentialBackoff) Next(attempt int, req *http.Request, resp *http.Response, err error) (delay time.Duration, retry bool) {
+	if !defaultRetryable(resp, err) {
+		return 0, false
+	}
+
+	d := float64(p.Base) * math.Pow(2, float64(attempt))
+	if p.Max > 0 && d > float64(p.Max) {
+		d = float64(p.Max)
+	}
+	if p.JitterFraction > 0 {
+		d *= 1 + (rand.Float64()*2-1)*p.JitterFraction
+	}
+	delay = time.Duration(d)
+
+	if d, ok := retryAfterDelay(resp); ok {
+		delay = d
+	}
+	return delay, true
+}
+
+// httpDownloaderPartSuffix is the suffix of the sidecar file persisted next to a partially
+// downloaded file so that a later resume attempt can tell whether it's still safe to append to
+// it.
+const httpDownloaderPartSuffix = ".astikit-part"
+
+// httpDownloaderSegmentSuffix is the suffix of the per-source files DownloadInFile downloads to
+// before concatenating them, in order, into the final destination.
+const httpDownloaderSegmentSuffix = ".astikit-segment"
+
+// httpDownloaderPart is the content of the <file>.astikit-part sidecar
+type httpDownloaderPart struct {
+	URL          string `json:"url"`
+	TotalSize    int64  `json:"total_size"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// HTTPDownloaderSrc is a source to download
+type HTTPDownloaderSrc struct {
+	URL string
+
+	// Resume indicates that, for file-based sinks (DownloadInFile, DownloadInDirectory), a
+	// previously interrupted download of this source may be resumed instead of restarted
+	// from scratch. It's only honored if the server supports range requests and the
+	// previously observed total size hasn't changed. Also enabled by
+	// HTTPDownloaderOptions.ResumeDefault.
+	Resume bool
+
+	// ExpectedSize, when > 0, is compared against the final downloaded size by DownloadInFile,
+	// DownloadInDirectory and DownloadSegmented with a file destination. On mismatch the
+	// downloaded file is discarded and an error is returned. DownloadInWriter and
+	// DownloadSegmented with an io.Writer destination don't check it.
+	ExpectedSize int64
+
+	// ExpectedSHA256, when set, is compared (hex-encoded) against the sha256 of the final
+	// downloaded content by DownloadInFile and DownloadInDirectory, and by DownloadSegmented
+	// only when SegmentedOptions.VerifySHA256 is true. On mismatch the downloaded content is
+	// discarded and an error is returned. DownloadInWriter doesn't check it.
+	ExpectedSHA256 string
+}
+
+// HTTPDownloaderOptions are HTTPDownloader options
+type HTTPDownloaderOptions struct {
+	Limiter GoroutineLimiterOptions
+	Sender  HTTPSenderOptions
+
+	// ResumeDefault is used as the default value of HTTPDownloaderSrc.Resume for every
+	// source that doesn't set it explicitly.
+	ResumeDefault bool
+
+	// OnEvent, when set, is called for every HTTPDownloaderEvent emitted over the lifetime of
+	// a download: DownloadStarted, DownloadProgress, DownloadRetried, DownloadFailed and
+	// DownloadCompleted. It may be called concurrently from several goroutines.
+	OnEvent func(HTTPDownloaderEvent)
+
+	// ProgressInterval is the minimum time between two DownloadProgress events emitted for the
+	// same source. Defaults to 1s.
+	ProgressInterval time.Duration
+}
+
+// HTTPDownloaderEvent is emitted by a HTTPDownloader over the lifetime of a download. It's
+// implemented by DownloadStarted, DownloadProgress, DownloadRetried, DownloadFailed and
+// DownloadCompleted.
+type HTTPDownloaderEvent interface{ isHTTPDownloaderEvent() }
+
+// DownloadStarted is emitted once a source's response has been received and its body is about to
+// be read. TotalBytes is -1 if the server didn't report a Content-Length.
+type DownloadStarted struct {
+	Src        HTTPDownloaderSrc
+	TotalBytes int64
+}
+
+func (DownloadStarted) isHTTPDownloaderEvent() {}
+
+// DownloadProgress is emitted at most every HTTPDownloaderOptions.ProgressInterval while a
+// source's body is being read. TotalBytes is -1 if the server didn't report a Content-Length.
+type DownloadProgress struct {
+	Src        HTTPDownloaderSrc
+	BytesRead  int64
+	TotalBytes int64
+}
+
+func (DownloadProgress) isHTTPDownloaderEvent() {}
+
+// DownloadRetried is emitted every time HTTPSender retries a request made on behalf of Src.
+type DownloadRetried struct {
+	Src     HTTPDownloaderSrc
+	Attempt int
+	Err     error
+}
+
+func (DownloadRetried) isHTTPDownloaderEvent() {}
+
+// DownloadFailed is emitted once a source's download has definitively failed.
+type DownloadFailed struct {
+	Src HTTPDownloaderSrc
+	Err error
+}
+
+func (DownloadFailed) isHTTPDownloaderEvent() {}
+
+// DownloadCompleted is emitted once a source has been downloaded successfully.
+type DownloadCompleted struct {
+	Src       HTTPDownloaderSrc
+	BytesRead int64
+	Duration  time.Duration
+}
+
+func (DownloadCompleted) isHTTPDownloaderEvent() {}
+
+// HTTPDownloaderStats is a point-in-time snapshot of a HTTPDownloader's counters, returned by
+// HTTPDownloader.Stats.
+type HTTPDownloaderStats struct {
+	Successes int64
+	Failures  int64
+	Retries   int64
+	Bytes     int64
+}
+
+// HTTPDownloader downloads one or several HTTPDownloaderSrc concurrently, up to a configurable
+// number of goroutines at a time.
+type HTTPDownloader struct {
+	l     *GoroutineLimiter
+	o     HTTPDownloaderOptions
+	s     *HTTPSender
+	stats HTTPDownloaderStats
+}
+
+// NewHTTPDownloader creates a new HTTPDownloader
+func NewHTTPDownloader(o HTTPDownloaderOptions) *HTTPDownloader {
+	if o.ProgressInterval <= 0 {
+		o.ProgressInterval = time.Second
+	}
+	return &HTTPDownloader{
+		l: NewGoroutineLimiter(o.Limiter),
+		o: o,
+		s: NewHTTPSender(o.Sender),
+	}
+}
+
+// Close closes the downloader
+func (d *HTTPDownloader) Close() { d.l.Close() }
+
+// Stats returns a snapshot of the downloader's counters
+func (d *HTTPDownloader) Stats() HTTPDownloaderStats {
+	return HTTPDownloaderStats{
+		Successes: atomic.LoadInt64(&d.stats.Successes),
+		Failures:  atomic.LoadInt64(&d.stats.Failures),
+		Retries:   atomic.LoadInt64(&d.stats.Retries),
+		Bytes:     atomic.LoadInt64(&d.stats.Bytes),
+	}
+}
+
+// emit calls OnEvent with e, if set
+func (d *HTTPDownloader) emit(e HTTPDownloaderEvent) {
+	if d.o.OnEvent != nil {
+		d.o.OnEvent(e)
+	}
+}
+
+// withRetryObserver returns a context that reports every retry of a request made on behalf of
+// src as a DownloadRetried event, and counts it in the downloader's stats.
+func (d *HTTPDownloader) withRetryObserver(ctx context.Context, src HTTPDownloaderSrc) context.Context {
+	return WithHTTPSenderRetryObserver(ctx, func(attempt int, resp *http.Response, err error) {
+		atomic.AddInt64(&d.stats.Retries, 1)
+		if err == nil {
+			err = fmt.Errorf("astikit: status code %d", resp.StatusCode)
+		}
+		d.emit(DownloadRetried{Src: src, Attempt: attempt, Err: err})
+	})
+}
+
+// countingReader wraps r, calling onRead after every successful Read with the number of bytes
+// just read
+type countingReader struct {
+	r      io.Reader
+	onRead func(n int64)
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	if n > 0 && r.onRead != nil {
+		r.onRead(int64(n))
+	}
+	return
+}
+
+// progressReader wraps body in a countingReader that reports BytesRead/TotalBytes progress for
+// src, at most every d.o.ProgressInterval, and returns the running read count
+func (d *HTTPDownloader) progressReader(body io.Reader, src HTTPDownloaderSrc, totalBytes int64) (r io.Reader, read *int64) {
+	read = new(int64)
+	var last time.Time
+	r = &countingReader{
+		r: body,
+		onRead: func(n int64) {
+			total := atomic.AddInt64(read, n)
+			if now := time.Now(); last.IsZero() || now.Sub(last) >= d.o.ProgressInterval {
+				last = now
+				d.emit(DownloadProgress{Src: src, BytesRead: total, TotalBytes: totalBytes})
+			}
+		},
+	}
+	return
+}
+
+// DownloadInWriter downloads srcs, in order, into w
+func (d *HTTPDownloader) DownloadInWriter(ctx context.Context, w io.Writer, srcs ...HTTPDownloaderSrc) (err error) {
+	bs := make([][]byte, len(srcs))
+	for idx, src := range srcs {
+		idx, src := idx, src
+		d.l.Do(func() (err error) {
+			start := time.Now()
+			var resp *http.Response
+			if resp, err = d.get(d.withRetryObserver(ctx, src), src.URL, 0); err != nil {
+				atomic.AddInt64(&d.stats.Failures, 1)
+				d.emit(DownloadFailed{Src: src, Err: err})
+				return err
+			}
+			defer resp.Body.Close()
+
+			total := resp.ContentLength
+			d.emit(DownloadStarted{Src: src, TotalBytes: total})
+			r, read := d.progressReader(resp.Body, src, total)
+
+			if bs[idx], err = ioutil.ReadAll(r); err != nil {
+				err = fmt.Errorf("astikit: reading body of %s failed: %w", src.URL, err)
+				atomic.AddInt64(&d.stats.Failures, 1)
+				d.emit(DownloadFailed{Src: src, Err: err})
+				return err
+			}
+
+			atomic.AddInt64(&d.stats.Successes, 1)
+			atomic.AddInt64(&d.stats.Bytes, atomic.LoadInt64(read))
+			d.emit(DownloadCompleted{Src: src, BytesRead: atomic.LoadInt64(read), Duration: time.Since(start)})
+			return nil
+		})
+	}
+	if err = d.l.Wait(); err != nil {
+		return err
+	}
+	for _, b := range bs {
+		if _, err = w.Write(b); err != nil {
+			return fmt.Errorf("astikit: writing failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// DownloadInFile downloads srcs and concatenates them, in order, into the file at dst
+func (d *HTTPDownloader) DownloadInFile(ctx context.Context, dst string, srcs ...HTTPDownloaderSrc) (err error) {
+	segments := make([]string, len(srcs))
+	for idx, src := range srcs {
+		idx, src := idx, src
+		p := fmt.Sprintf("%s%s%d", dst, httpDownloaderSegmentSuffix, idx)
+		segments[idx] = p
+		d.l.Do(func() error {
+			return d.downloadToFile(ctx, p, src)
+		})
+	}
+	if err = d.l.Wait(); err != nil {
+		return err
+	}
+
+	var f *os.File
+	if f, err = os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644); err != nil {
+		return fmt.Errorf("astikit: creating %s failed: %w", dst, err)
+	}
+	defer f.Close()
+
+	for _, p := range segments {
+		if err = appendFile(f, p); err != nil {
+			return err
+		}
+		os.Remove(p)
+	}
+	return nil
+}
+
+// appendFile appends the content of the file at src to f
+func appendFile(f *os.File, src string) (err error) {
+	var sf *os.File
+	if sf, err = os.Open(src); err != nil {
+		return fmt.Errorf("astikit: opening %s failed: %w", src, err)
+	}
+	defer sf.Close()
+	if _, err = io.Copy(f, sf); err != nil {
+		return fmt.Errorf("astikit: copying %s failed: %w", src, err)
+	}
+	return nil
+}
+
+// DownloadInDirectory downloads srcs into dir, one file per source, named after the last path
+// segment of its URL
+func (d *HTTPDownloader) DownloadInDirectory(ctx context.Context, dir string, srcs ...HTTPDownloaderSrc) (err error) {
+	for _, src := range srcs {
+		src := src
+		dst := filepath.Join(dir, path.Base(src.URL))
+		d.l.Do(func() error {
+			return d.downloadToFile(ctx, dst, src)
+		})
+	}
+	return d.l.Wait()
+}
+
+// get issues a GET request for u, optionally resuming from offset
+func (d *HTTPDownloader) get(ctx context.Context, u string, offset int64) (resp *http.Response, err error) {
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, u, nil); err != nil {
+		return nil, fmt.Errorf("astikit: creating request failed: %w", err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	if resp, err = d.s.Send(req); err != nil {
+		return nil, fmt.Errorf("astikit: sending request failed: %w", err)
+	}
+	return resp, nil
+}
+
+// head issues a HEAD request for u
+func (d *HTTPDownloader) head(ctx context.Context, u string) (resp *http.Response, err error) {
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodHead, u, nil); err != nil {
+		return nil, fmt.Errorf("astikit: creating request failed: %w", err)
+	}
+	if resp, err = d.s.Send(req); err != nil {
+		return nil, fmt.Errorf("astikit: sending request failed: %w", err)
+	}
+	return resp, nil
+}
+
+// downloadToFile downloads src into dst, resuming a previous attempt when possible and asked to,
+// and reports DownloadFailed if it doesn't succeed.
+func (d *HTTPDownloader) downloadToFile(ctx context.Context, dst string, src HTTPDownloaderSrc) (err error) {
+	if err = d.downloadToFileAttempt(ctx, dst, src, time.Now()); err != nil {
+		atomic.AddInt64(&d.stats.Failures, 1)
+		d.emit(DownloadFailed{Src: src, Err: err})
+	}
+	return err
+}
+
+// downloadToFileAttempt is the actual implementation of downloadToFile
+func (d *HTTPDownloader) downloadToFileAttempt(ctx context.Context, dst string, src HTTPDownloaderSrc, start time.Time) (err error) {
+	ctx = d.withRetryObserver(ctx, src)
+	resume := src.Resume || d.o.ResumeDefault
+	partPath := dst + httpDownloaderPartSuffix
+
+	// A single retry is allowed: if the server doesn't honor a resume attempt the way we
+	// expect, we fall back to a clean restart instead of failing outright.
+	for attempt := 0; attempt < 2; attempt++ {
+		var offset int64
+		var prev httpDownloaderPart
+		if resume {
+			if offset, prev, err = readResumeState(dst, partPath, src.URL); err != nil {
+				return err
+			}
+		}
+
+		var etag, lastModified string
+		if offset > 0 {
+			var head *http.Response
+			if head, err = d.head(ctx, src.URL); err != nil {
+				return err
+			}
+			head.Body.Close()
+			etag = head.Header.Get("ETag")
+			lastModified = head.Header.Get("Last-Modified")
+
+			// The server's own HEAD-reported size/identity must still match what we
+			// saw when the partial file was written, and it must still advertise
+			// range support, or we can't trust appending to it.
+			if head.Header.Get("Accept-Ranges") != "bytes" ||
+				head.ContentLength <= 0 ||
+				head.ContentLength != prev.TotalSize ||
+				offset > head.ContentLength ||
+				(prev.ETag != "" && etag != prev.ETag) ||
+				(prev.LastModified != "" && lastModified != prev.LastModified) {
+				os.Remove(dst)
+				os.Remove(partPath)
+				offset = 0
+			}
+		}
+
+		var resp *http.Response
+		if resp, err = d.get(ctx, src.URL, offset); err != nil {
+			return err
+		}
+
+		if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+			// The server returned a full body (e.g. 200) instead of honoring our
+			// Range header: restart from scratch rather than append it to the
+			// existing partial file.
+			resp.Body.Close()
+			os.Remove(dst)
+			os.Remove(partPath)
+			continue
+		}
+
+		return d.writeToFile(resp, dst, partPath, offset, src, etag, lastModified, resume, start)
+	}
+	return fmt.Errorf("astikit: resuming %s failed after falling back to a clean restart", src.URL)
+}
+
+// readResumeState returns the offset to resume dst's download from, and the sidecar metadata it
+// was recorded with, or a zero offset if dst/partPath don't describe a resumable state.
+func readResumeState(dst, partPath, url string) (offset int64, part httpDownloaderPart, err error) {
+	fi, statErr := os.Stat(dst)
+	if statErr != nil || fi.Size() == 0 {
+		return 0, part, nil
+	}
+	b, readErr := ioutil.ReadFile(partPath)
+	if readErr != nil {
+		return 0, part, nil
+	}
+	if jsonErr := json.Unmarshal(b, &part); jsonErr != nil || part.URL != url {
+		return 0, httpDownloaderPart{}, nil
+	}
+	return fi.Size(), part, nil
+}
+
+// writeToFile writes resp's body to dst (appending if offset > 0), persists the resume sidecar
+// and validates src's expected size/checksum once done.
+func (d *HTTPDownloader) writeToFile(resp *http.Response, dst, partPath string, offset int64, src HTTPDownloaderSrc, etag, lastModified string, resume bool, start time.Time) (err error) {
+	defer resp.Body.Close()
+
+	total := resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent && total >= 0 {
+		total += offset
+	}
+
+	// On a first-ever attempt at src (offset == 0) no HEAD was issued, so etag/lastModified
+	// haven't been populated yet: capture them off this GET response instead, or the sidecar
+	// would be persisted with an empty ETag/Last-Modified and could never be validated on the
+	// next resume attempt.
+	if offset == 0 {
+		etag = resp.Header.Get("ETag")
+		lastModified = resp.Header.Get("Last-Modified")
+	}
+
+	d.emit(DownloadStarted{Src: src, TotalBytes: total})
+	r, read := d.progressReader(resp.Body, src, total)
+
+	// The sidecar must exist on disk *before* the copy starts, not after: it's what lets a
+	// process killed mid-copy be resumed on the next run. It's left behind if the copy fails,
+	// and removed once the copy completes or whenever dst itself is discarded.
+	if resume && total > 0 {
+		var b []byte
+		if b, err = json.Marshal(httpDownloaderPart{URL: src.URL, TotalSize: total, ETag: etag, LastModified: lastModified}); err == nil {
+			ioutil.WriteFile(partPath, b, 0644)
+		}
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY
+	if offset > 0 {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+	var f *os.File
+	if f, err = os.OpenFile(dst, flags, 0644); err != nil {
+		return fmt.Errorf("astikit: opening %s failed: %w", dst, err)
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("astikit: writing to %s failed: %w", dst, err)
+	}
+	f.Close()
+
+	if src.ExpectedSize > 0 || src.ExpectedSHA256 != "" {
+		if err = checkDownloadedFile(dst, src); err != nil {
+			os.Remove(dst)
+			os.Remove(partPath)
+			return err
+		}
+	}
+
+	os.Remove(partPath)
+	atomic.AddInt64(&d.stats.Successes, 1)
+	bytesRead := atomic.LoadInt64(read)
+	atomic.AddInt64(&d.stats.Bytes, bytesRead)
+	d.emit(DownloadCompleted{Src: src, BytesRead: bytesRead, Duration: time.Since(start)})
+	return nil
+}
+
+// checkDownloadedFile verifies the file at dst against src's expected size and/or checksum
+func checkDownloadedFile(dst string, src HTTPDownloaderSrc) (err error) {
+	var f *os.File
+	if f, err = os.Open(dst); err != nil {
+		return fmt.Errorf("astikit: opening %s failed: %w", dst, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	var n int64
+	if n, err = io.Copy(h, f); err != nil {
+		return fmt.Errorf("astikit: hashing %s failed: %w", dst, err)
+	}
+
+	if src.ExpectedSize > 0 && n != src.ExpectedSize {
+		return fmt.Errorf("astikit: downloaded size %d for %s doesn't match expected size %d", n, src.URL, src.ExpectedSize)
+	}
+	if src.ExpectedSHA256 != "" {
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != src.ExpectedSHA256 {
+			return fmt.Errorf("astikit: downloaded sha256 %s for %s doesn't match expected sha256 %s", sum, src.URL, src.ExpectedSHA256)
+		}
+	}
+	return nil
+}
+
+// SegmentedOptions are DownloadSegmented options
+type SegmentedOptions struct {
+	// Segments is the number of parallel range requests to split the download into. Defaults
+	// to 4.
+	Segments int
+
+	// MinSegmentSize is the minimum size, in bytes, of a single segment: Segments is reduced
+	// if splitting the download into that many parts would go below it. Defaults to 1MB.
+	MinSegmentSize int64
+
+	// VerifySHA256, when true, verifies the reassembled content against src.ExpectedSHA256
+	// once complete, discarding it on mismatch. When the server doesn't advertise range
+	// support and the destination is an io.Writer, the single-stream fallback writes the
+	// content without this check.
+	VerifySHA256 bool
+}
+
+// httpSegment is an inclusive byte range to be fetched in one Range request
+type httpSegment struct{ start, end int64 }
+
+// segmentRanges splits [0, size) into evenly-sized inclusive ranges, honoring opts.Segments and
+// opts.MinSegmentSize
+func segmentRanges(size int64, opts SegmentedOptions) []httpSegment {
+	n := opts.Segments
+	if n <= 0 {
+		n = 4
+	}
+	minSize := opts.MinSegmentSize
+	if minSize <= 0 {
+		minSize = 1 << 20
+	}
+	if max := int(size / minSize); max < n {
+		n = max
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	segs := make([]httpSegment, 0, n)
+	segSize := size / int64(n)
+	var start int64
+	for i := 0; i < n; i++ {
+		end := start + segSize - 1
+		if i == n-1 {
+			end = size - 1
+		}
+		segs = append(segs, httpSegment{start: start, end: end})
+		start = end + 1
+	}
+	return segs
+}
+
+// getRange issues a GET request for u with a Range header covering [start, end]
+func (d *HTTPDownloader) getRange(ctx context.Context, u string, start, end int64) (resp *http.Response, err error) {
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, u, nil); err != nil {
+		return nil, fmt.Errorf("astikit: creating request failed: %w", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if resp, err = d.s.Send(req); err != nil {
+		return nil, fmt.Errorf("astikit: sending request failed: %w", err)
+	}
+	return resp, nil
+}
+
+// offsetWriter writes to f starting at offset, advancing it as data is written, so that it can
+// be used as the io.Writer destination of an io.Copy without buffering a whole segment in
+// memory.
+type offsetWriter struct {
+	f      *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (n int, err error) {
+	if n, err = w.f.WriteAt(p, w.offset); err != nil {
+		return n, err
+	}
+	w.offset += int64(n)
+	return n, nil
+}
+
+// segmentedProgressReader is like progressReader, but for use by several segments of the same
+// source downloading concurrently: read and last are shared across all of them, read being
+// updated atomically and last being guarded by mu.
+func (d *HTTPDownloader) segmentedProgressReader(body io.Reader, src HTTPDownloaderSrc, total int64, read *int64, mu *sync.Mutex, last *time.Time) io.Reader {
+	return &countingReader{
+		r: body,
+		onRead: func(n int64) {
+			cur := atomic.AddInt64(read, n)
+			mu.Lock()
+			if now := time.Now(); last.IsZero() || now.Sub(*last) >= d.o.ProgressInterval {
+				*last = now
+				d.emit(DownloadProgress{Src: src, BytesRead: cur, TotalBytes: total})
+			}
+			mu.Unlock()
+		},
+	}
+}
+
+// DownloadSegmented downloads a single, large src in opts.Segments parallel Range requests and
+// reassembles them, in order, into dst, which must be an io.Writer or a destination file path
+// (string). It falls back to a plain single-stream download if the server doesn't advertise
+// range support.
+func (d *HTTPDownloader) DownloadSegmented(ctx context.Context, dst interface{}, src HTTPDownloaderSrc, opts SegmentedOptions) (err error) {
+	var head *http.Response
+	if head, err = d.head(ctx, src.URL); err != nil {
+		return err
+	}
+	head.Body.Close()
+
+	if head.Header.Get("Accept-Ranges") != "bytes" || head.ContentLength <= 0 {
+		// Falls back to a plain single-stream download. For a file destination it honors
+		// src.ExpectedSHA256 unconditionally: strip it here when opts.VerifySHA256 is false so
+		// the same (src, opts) pair gets the same integrity checks as on the segmented path.
+		// For an io.Writer destination it goes through DownloadInWriter, which doesn't check
+		// src.ExpectedSHA256 even when opts.VerifySHA256 is true.
+		fallbackSrc := src
+		if !opts.VerifySHA256 {
+			fallbackSrc.ExpectedSHA256 = ""
+		}
+		switch sink := dst.(type) {
+		case string:
+			return d.downloadToFile(ctx, sink, fallbackSrc)
+		case io.Writer:
+			return d.DownloadInWriter(ctx, sink, fallbackSrc)
+		default:
+			return fmt.Errorf("astikit: unsupported DownloadSegmented destination type %T", dst)
+		}
+	}
+
+	segs := segmentRanges(head.ContentLength, opts)
+	switch sink := dst.(type) {
+	case string:
+		return d.downloadSegmentedToFile(ctx, sink, src, segs, opts)
+	case io.Writer:
+		return d.downloadSegmentedToWriter(ctx, sink, src, segs, opts)
+	default:
+		return fmt.Errorf("astikit: unsupported DownloadSegmented destination type %T", dst)
+	}
+}
+
+// downloadSegmentedToFile implements DownloadSegmented for a file destination
+func (d *HTTPDownloader) downloadSegmentedToFile(ctx context.Context, dst string, src HTTPDownloaderSrc, segs []httpSegment, opts SegmentedOptions) (err error) {
+	start := time.Now()
+	size := segs[len(segs)-1].end + 1
+	d.emit(DownloadStarted{Src: src, TotalBytes: size})
+
+	tmp := dst + httpDownloaderSegmentSuffix + "-tmp"
+	var f *os.File
+	if f, err = os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644); err != nil {
+		err = fmt.Errorf("astikit: creating %s failed: %w", tmp, err)
+		atomic.AddInt64(&d.stats.Failures, 1)
+		d.emit(DownloadFailed{Src: src, Err: err})
+		return err
+	}
+	if err = f.Truncate(size); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		err = fmt.Errorf("astikit: preallocating %s failed: %w", tmp, err)
+		atomic.AddInt64(&d.stats.Failures, 1)
+		d.emit(DownloadFailed{Src: src, Err: err})
+		return err
+	}
+
+	var read int64
+	var mu sync.Mutex
+	var last time.Time
+	ctx = d.withRetryObserver(ctx, src)
+	for _, seg := range segs {
+		seg := seg
+		d.l.Do(func() (err error) {
+			var resp *http.Response
+			if resp, err = d.getRange(ctx, src.URL, seg.start, seg.end); err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusPartialContent {
+				return fmt.Errorf("astikit: expected status %d for segment [%d-%d] of %s, got %d", http.StatusPartialContent, seg.start, seg.end, src.URL, resp.StatusCode)
+			}
+			r := d.segmentedProgressReader(resp.Body, src, size, &read, &mu, &last)
+			var n int64
+			if n, err = io.Copy(&offsetWriter{f: f, offset: seg.start}, r); err != nil {
+				return fmt.Errorf("astikit: writing segment [%d-%d] of %s failed: %w", seg.start, seg.end, src.URL, err)
+			}
+			if want := seg.end - seg.start + 1; n != want {
+				return fmt.Errorf("astikit: segment [%d-%d] of %s is short: expected %d bytes, got %d", seg.start, seg.end, src.URL, want, n)
+			}
+			return nil
+		})
+	}
+	if err = d.l.Wait(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		atomic.AddInt64(&d.stats.Failures, 1)
+		d.emit(DownloadFailed{Src: src, Err: err})
+		return err
+	}
+	f.Close()
+
+	if src.ExpectedSize > 0 || (opts.VerifySHA256 && src.ExpectedSHA256 != "") {
+		checkSrc := src
+		if !opts.VerifySHA256 {
+			checkSrc.ExpectedSHA256 = ""
+		}
+		if err = checkDownloadedFile(tmp, checkSrc); err != nil {
+			os.Remove(tmp)
+			atomic.AddInt64(&d.stats.Failures, 1)
+			d.emit(DownloadFailed{Src: src, Err: err})
+			return err
+		}
+	}
+
+	if err = os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		err = fmt.Errorf("astikit: moving %s to %s failed: %w", tmp, dst, err)
+		atomic.AddInt64(&d.stats.Failures, 1)
+		d.emit(DownloadFailed{Src: src, Err: err})
+		return err
+	}
+
+	atomic.AddInt64(&d.stats.Successes, 1)
+	atomic.AddInt64(&d.stats.Bytes, read)
+	d.emit(DownloadCompleted{Src: src, BytesRead: read, Duration: time.Since(start)})
+	return nil
+}
+
+// downloadSegmentedToWriter implements DownloadSegmented for an io.Writer destination: each
+// segment is buffered in memory and, once every segment has finished, streamed to w in order.
+func (d *HTTPDownloader) downloadSegmentedToWriter(ctx context.Context, w io.Writer, src HTTPDownloaderSrc, segs []httpSegment, opts SegmentedOptions) (err error) {
+	start := time.Now()
+	size := segs[len(segs)-1].end + 1
+	d.emit(DownloadStarted{Src: src, TotalBytes: size})
+
+	bufs := make([][]byte, len(segs))
+	var read int64
+	var mu sync.Mutex
+	var last time.Time
+	ctx = d.withRetryObserver(ctx, src)
+	for idx, seg := range segs {
+		idx, seg := idx, seg
+		d.l.Do(func() (err error) {
+			var resp *http.Response
+			if resp, err = d.getRange(ctx, src.URL, seg.start, seg.end); err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusPartialContent {
+				return fmt.Errorf("astikit: expected status %d for segment [%d-%d] of %s, got %d", http.StatusPartialContent, seg.start, seg.end, src.URL, resp.StatusCode)
+			}
+			r := d.segmentedProgressReader(resp.Body, src, size, &read, &mu, &last)
+			if bufs[idx], err = ioutil.ReadAll(r); err != nil {
+				return fmt.Errorf("astikit: reading segment [%d-%d] of %s failed: %w", seg.start, seg.end, src.URL, err)
+			}
+			if want := seg.end - seg.start + 1; int64(len(bufs[idx])) != want {
+				return fmt.Errorf("astikit: segment [%d-%d] of %s is short: expected %d bytes, got %d", seg.start, seg.end, src.URL, want, len(bufs[idx]))
+			}
+			return nil
+		})
+	}
+	if err = d.l.Wait(); err != nil {
+		atomic.AddInt64(&d.stats.Failures, 1)
+		d.emit(DownloadFailed{Src: src, Err: err})
+		return err
+	}
+
+	if opts.VerifySHA256 && src.ExpectedSHA256 != "" {
+		h := sha256.New()
+		for _, b := range bufs {
+			h.Write(b)
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != src.ExpectedSHA256 {
+			err = fmt.Errorf("astikit: downloaded sha256 %s for %s doesn't match expected sha256 %s", sum, src.URL, src.ExpectedSHA256)
+			atomic.AddInt64(&d.stats.Failures, 1)
+			d.emit(DownloadFailed{Src: src, Err: err})
+			return err
+		}
+	}
+
+	for _, b := range bufs {
+		if _, err = w.Write(b); err != nil {
+			err = fmt.Errorf("astikit: writing failed: %w", err)
+			atomic.AddInt64(&d.stats.Failures, 1)
+			d.emit(DownloadFailed{Src: src, Err: err})
+			return err
+		}
+	}
+
+	atomic.AddInt64(&d.stats.Successes, 1)
+	atomic.AddInt64(&d.stats.Bytes, read)
+	d.emit(DownloadCompleted{Src: src, BytesRead: read, Duration: time.Since(start)})
+	return nil
+}
@@ -3,12 +3,17 @@ package astikit
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -40,6 +45,102 @@ func TestServeHTTP(t *testing.T) {
 	}
 }
 
+func TestServeHTTPGracefulShutdown(t *testing.T) {
+	w := NewWorker(WorkerOptions{})
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatalf("expected no error, got %+v", err)
+	}
+	ln.Close()
+
+	started := make(chan struct{})
+	var ctxDone bool
+	var pre, post int
+	var postErr error
+	if err := ServeHTTP(w, ServeHTTPOptions{
+		Addr: ln.Addr().String(),
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			close(started)
+			// Observes the worker being stopped through context cancellation instead of
+			// relying on a sleep to line up with the shutdown.
+			<-req.Context().Done()
+			ctxDone = true
+		}),
+		PreShutdown:  func() { pre++ },
+		PostShutdown: func(err error) { post++; postErr = err },
+	}); err != nil {
+		t.Fatalf("expected no error, got %+v", err)
+	}
+
+	go func() {
+		c := &http.Client{}
+		r, _ := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String(), nil)
+		c.Do(r)
+	}()
+
+	<-started
+	w.Stop()
+	w.Wait()
+
+	if !ctxDone {
+		t.Error("expected the handler to observe the context being canceled")
+	}
+	if e := 1; pre != e {
+		t.Errorf("expected PreShutdown to be called %v time, got %v", e, pre)
+	}
+	if e := 1; post != e {
+		t.Errorf("expected PostShutdown to be called %v time, got %v", e, post)
+	}
+	if postErr != nil {
+		t.Errorf("expected no error, got %+v", postErr)
+	}
+}
+
+func TestServeHTTPShutdownForceClose(t *testing.T) {
+	w := NewWorker(WorkerOptions{})
+	ln, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatalf("expected no error, got %+v", err)
+	}
+	ln.Close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	var postErr error
+	if err := ServeHTTP(w, ServeHTTPOptions{
+		Addr: ln.Addr().String(),
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			close(started)
+			// Ignores context cancellation on purpose, to force Shutdown past its timeout
+			<-release
+		}),
+		ShutdownTimeout: time.Millisecond,
+		PostShutdown: func(err error) {
+			postErr = err
+			close(done)
+		},
+	}); err != nil {
+		t.Fatalf("expected no error, got %+v", err)
+	}
+
+	go func() {
+		c := &http.Client{}
+		r, _ := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String(), nil)
+		c.Do(r)
+	}()
+
+	<-started
+	w.Stop()
+	<-done
+	close(release)
+	w.Wait()
+
+	if postErr == nil {
+		t.Error("expected Shutdown to have timed out and been forced closed, got nil error")
+	}
+}
+
 type mockedHTTPClient func(req *http.Request) (*http.Response, error)
 
 func (c mockedHTTPClient) Do(req *http.Request) (*http.Response, error) { return c(req) }
@@ -50,6 +151,11 @@ func (err mockedNetError) Error() string   { return "" }
 func (err mockedNetError) Timeout() bool   { return false }
 func (err mockedNetError) Temporary() bool { return err.temporary }
 
+// erroringReader simulates a connection dropping mid-transfer: every read fails
+type erroringReader struct{}
+
+func (erroringReader) Read(p []byte) (int, error) { return 0, errors.New("connection reset") }
+
 func TestHTTPSender(t *testing.T) {
 	// All errors
 	var c int
@@ -96,6 +202,65 @@ func TestHTTPSender(t *testing.T) {
 	}
 }
 
+func TestHTTPSenderRetryPolicy(t *testing.T) {
+	// Custom RetryPolicy is honored, including non-retryable statuses it allows
+	var delays []time.Duration
+	var c int
+	s := NewHTTPSender(HTTPSenderOptions{
+		Client: mockedHTTPClient(func(req *http.Request) (resp *http.Response, err error) {
+			c++
+			resp = &http.Response{StatusCode: http.StatusBadRequest}
+			return
+		}),
+		RetryMax: 2,
+		RetryPolicy: testRetryPolicy(func(attempt int, req *http.Request, resp *http.Response, err error) (time.Duration, bool) {
+			d := time.Duration(attempt+1) * time.Millisecond
+			delays = append(delays, d)
+			return d, true
+		}),
+	})
+	if _, err := s.Send(&http.Request{}); err == nil {
+		t.Error("expected error, got nil")
+	}
+	if e := 3; c != e {
+		t.Errorf("expected %v, got %v", e, c)
+	}
+	if e := []time.Duration{time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond}; !reflect.DeepEqual(e, delays) {
+		t.Errorf("expected %+v, got %+v", e, delays)
+	}
+
+	// ExponentialBackoff honors Retry-After over its computed delay
+	p := ExponentialBackoff{Base: time.Second, Max: time.Minute}
+	resp := &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Header:     http.Header{"Retry-After": []string{"2"}},
+	}
+	d, retry := p.Next(0, &http.Request{}, resp, nil)
+	if !retry {
+		t.Error("expected retry, got false")
+	}
+	if e := 2 * time.Second; d != e {
+		t.Errorf("expected %v, got %v", e, d)
+	}
+
+	// Non-transient errors and non-retryable statuses aren't retried
+	if _, retry = p.Next(0, &http.Request{}, &http.Response{StatusCode: http.StatusBadRequest}, nil); retry {
+		t.Error("expected no retry, got true")
+	}
+	if _, retry = p.Next(0, &http.Request{}, nil, errors.New("oops")); retry {
+		t.Error("expected no retry, got true")
+	}
+	if _, retry = p.Next(0, &http.Request{}, nil, NewTransientError(errors.New("oops"))); !retry {
+		t.Error("expected retry, got false")
+	}
+}
+
+type testRetryPolicy func(attempt int, req *http.Request, resp *http.Response, err error) (time.Duration, bool)
+
+func (f testRetryPolicy) Next(attempt int, req *http.Request, resp *http.Response, err error) (time.Duration, bool) {
+	return f(attempt, req, resp, err)
+}
+
 func TestHTTPDownloader(t *testing.T) {
 	// Create temp dir
 	dir, err := ioutil.TempDir("", "")
@@ -194,3 +359,429 @@ func TestHTTPDownloader(t *testing.T) {
 	}
 	checkFile(t, p, "/path/to/1/path/to/2/path/to/3")
 }
+
+func TestHTTPDownloaderResume(t *testing.T) {
+	const full = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	const offset = 10
+
+	// seed seeds dir with a partial download of full[:offset] plus a matching sidecar
+	seed := func(t *testing.T, dir string, part httpDownloaderPart) string {
+		dst := filepath.Join(dir, "x")
+		if err := ioutil.WriteFile(dst, []byte(full[:offset]), 0644); err != nil {
+			t.Fatalf("writing partial file failed: %+v", err)
+		}
+		b, err := json.Marshal(part)
+		if err != nil {
+			t.Fatalf("marshaling sidecar failed: %+v", err)
+		}
+		if err := ioutil.WriteFile(dst+httpDownloaderPartSuffix, b, 0644); err != nil {
+			t.Fatalf("writing sidecar failed: %+v", err)
+		}
+		return dst
+	}
+
+	// Resuming with a matching sidecar appends from offset via a single Range request
+	t.Run("resumes with a matching sidecar", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatalf("creating temp dir failed: %+v", err)
+		}
+		defer os.RemoveAll(dir)
+		dst := seed(t, dir, httpDownloaderPart{URL: "/x", TotalSize: int64(len(full)), ETag: "etag-1", LastModified: "lm-1"})
+
+		var gets int
+		client := mockedHTTPClient(func(req *http.Request) (resp *http.Response, err error) {
+			if req.Method == http.MethodHead {
+				return &http.Response{
+					StatusCode:    http.StatusOK,
+					ContentLength: int64(len(full)),
+					Header:        http.Header{"Accept-Ranges": []string{"bytes"}, "Etag": []string{"etag-1"}, "Last-Modified": []string{"lm-1"}},
+					Body:          ioutil.NopCloser(bytes.NewReader(nil)),
+				}, nil
+			}
+			gets++
+			if e := fmt.Sprintf("bytes=%d-", offset); e != req.Header.Get("Range") {
+				t.Errorf("expected Range %s, got %s", e, req.Header.Get("Range"))
+			}
+			return &http.Response{
+				StatusCode: http.StatusPartialContent,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(full[offset:])),
+			}, nil
+		})
+
+		d := NewHTTPDownloader(HTTPDownloaderOptions{Sender: HTTPSenderOptions{Client: client}})
+		defer d.Close()
+		if err := d.DownloadInDirectory(context.Background(), dir, HTTPDownloaderSrc{URL: "/x", Resume: true}); err != nil {
+			t.Errorf("expected no error, got %+v", err)
+		}
+		checkFile(t, dst, full)
+		if e := 1; gets != e {
+			t.Errorf("expected %v GET, got %v", e, gets)
+		}
+	})
+
+	// An ETag mismatch between the sidecar and the server's current HEAD means the partial
+	// file can no longer be trusted: truncate and restart from scratch
+	t.Run("truncates and restarts on ETag mismatch", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatalf("creating temp dir failed: %+v", err)
+		}
+		defer os.RemoveAll(dir)
+		dst := seed(t, dir, httpDownloaderPart{URL: "/x", TotalSize: int64(len(full)), ETag: "etag-1", LastModified: "lm-1"})
+
+		client := mockedHTTPClient(func(req *http.Request) (resp *http.Response, err error) {
+			if req.Method == http.MethodHead {
+				return &http.Response{
+					StatusCode:    http.StatusOK,
+					ContentLength: int64(len(full)),
+					Header:        http.Header{"Accept-Ranges": []string{"bytes"}, "Etag": []string{"etag-2"}},
+					Body:          ioutil.NopCloser(bytes.NewReader(nil)),
+				}, nil
+			}
+			if e := ""; e != req.Header.Get("Range") {
+				t.Errorf("expected no Range header, got %s", req.Header.Get("Range"))
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(full)),
+			}, nil
+		})
+
+		d := NewHTTPDownloader(HTTPDownloaderOptions{Sender: HTTPSenderOptions{Client: client}})
+		defer d.Close()
+		if err := d.DownloadInDirectory(context.Background(), dir, HTTPDownloaderSrc{URL: "/x", Resume: true}); err != nil {
+			t.Errorf("expected no error, got %+v", err)
+		}
+		checkFile(t, dst, full)
+	})
+
+	// If the server ignores the Range header and returns a full 200 body instead of a 206,
+	// restart from scratch instead of appending it to the existing partial file
+	t.Run("restarts on 200 instead of 206", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatalf("creating temp dir failed: %+v", err)
+		}
+		defer os.RemoveAll(dir)
+		dst := seed(t, dir, httpDownloaderPart{URL: "/x", TotalSize: int64(len(full)), ETag: "etag-1", LastModified: "lm-1"})
+
+		var gets int
+		client := mockedHTTPClient(func(req *http.Request) (resp *http.Response, err error) {
+			if req.Method == http.MethodHead {
+				return &http.Response{
+					StatusCode:    http.StatusOK,
+					ContentLength: int64(len(full)),
+					Header:        http.Header{"Accept-Ranges": []string{"bytes"}, "Etag": []string{"etag-1"}, "Last-Modified": []string{"lm-1"}},
+					Body:          ioutil.NopCloser(bytes.NewReader(nil)),
+				}, nil
+			}
+			gets++
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(full)),
+			}, nil
+		})
+
+		d := NewHTTPDownloader(HTTPDownloaderOptions{Sender: HTTPSenderOptions{Client: client}})
+		defer d.Close()
+		if err := d.DownloadInDirectory(context.Background(), dir, HTTPDownloaderSrc{URL: "/x", Resume: true}); err != nil {
+			t.Errorf("expected no error, got %+v", err)
+		}
+		checkFile(t, dst, full)
+		if e := 2; gets != e {
+			t.Errorf("expected %v GETs, got %v", e, gets)
+		}
+	})
+
+	// A fresh download (no prior partial file) issues no HEAD, so the sidecar's ETag/
+	// Last-Modified must be captured off the GET response itself: kill the transfer mid-copy
+	// (leaving the sidecar behind, same as a process getting killed) and check it recorded
+	// the real headers rather than empty strings
+	t.Run("captures ETag/Last-Modified from the GET response on a fresh download", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatalf("creating temp dir failed: %+v", err)
+		}
+		defer os.RemoveAll(dir)
+		dst := filepath.Join(dir, "x")
+
+		client := mockedHTTPClient(func(req *http.Request) (resp *http.Response, err error) {
+			return &http.Response{
+				StatusCode:    http.StatusOK,
+				ContentLength: int64(len(full)),
+				Header:        http.Header{"Etag": []string{"original-etag"}, "Last-Modified": []string{"original-lm"}},
+				Body:          ioutil.NopCloser(io.MultiReader(bytes.NewBufferString(full[:offset]), erroringReader{})),
+			}, nil
+		})
+
+		d := NewHTTPDownloader(HTTPDownloaderOptions{Sender: HTTPSenderOptions{Client: client}})
+		defer d.Close()
+		if err := d.DownloadInDirectory(context.Background(), dir, HTTPDownloaderSrc{URL: "/x", Resume: true}); err == nil {
+			t.Error("expected error, got nil")
+		}
+
+		b, err := ioutil.ReadFile(dst + httpDownloaderPartSuffix)
+		if err != nil {
+			t.Fatalf("reading sidecar failed: %+v", err)
+		}
+		var part httpDownloaderPart
+		if err := json.Unmarshal(b, &part); err != nil {
+			t.Fatalf("unmarshaling sidecar failed: %+v", err)
+		}
+		if e := "original-etag"; part.ETag != e {
+			t.Errorf("expected ETag %s, got %s", e, part.ETag)
+		}
+		if e := "original-lm"; part.LastModified != e {
+			t.Errorf("expected Last-Modified %s, got %s", e, part.LastModified)
+		}
+	})
+
+	// ExpectedSize/ExpectedSHA256 mismatches discard the downloaded file
+	t.Run("discards the file on ExpectedSize/ExpectedSHA256 mismatch", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatalf("creating temp dir failed: %+v", err)
+		}
+		defer os.RemoveAll(dir)
+		dst := filepath.Join(dir, "x")
+
+		client := mockedHTTPClient(func(req *http.Request) (resp *http.Response, err error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(full)),
+			}, nil
+		})
+
+		d := NewHTTPDownloader(HTTPDownloaderOptions{Sender: HTTPSenderOptions{Client: client}})
+		defer d.Close()
+		if err := d.DownloadInDirectory(context.Background(), dir, HTTPDownloaderSrc{URL: "/x", ExpectedSize: int64(len(full)) + 1}); err == nil {
+			t.Error("expected error, got nil")
+		}
+		if _, err := os.Stat(dst); !os.IsNotExist(err) {
+			t.Errorf("expected %s to have been discarded, got err %+v", dst, err)
+		}
+		if _, err := os.Stat(dst + httpDownloaderPartSuffix); !os.IsNotExist(err) {
+			t.Errorf("expected sidecar to have been discarded, got err %+v", err)
+		}
+
+		if err := d.DownloadInDirectory(context.Background(), dir, HTTPDownloaderSrc{URL: "/x", ExpectedSHA256: strings.Repeat("0", 64)}); err == nil {
+			t.Error("expected error, got nil")
+		}
+		if _, err := os.Stat(dst); !os.IsNotExist(err) {
+			t.Errorf("expected %s to have been discarded, got err %+v", dst, err)
+		}
+	})
+}
+
+func TestHTTPDownloaderEvents(t *testing.T) {
+	var events []HTTPDownloaderEvent
+	d := NewHTTPDownloader(HTTPDownloaderOptions{
+		Sender: HTTPSenderOptions{
+			Client: mockedHTTPClient(func(req *http.Request) (resp *http.Response, err error) {
+				resp = &http.Response{
+					Body:          ioutil.NopCloser(bytes.NewBufferString("hello")),
+					StatusCode:    http.StatusOK,
+					ContentLength: 5,
+				}
+				return
+			}),
+		},
+		OnEvent: func(e HTTPDownloaderEvent) { events = append(events, e) },
+	})
+	defer d.Close()
+
+	w := &bytes.Buffer{}
+	if err := d.DownloadInWriter(context.Background(), w, HTTPDownloaderSrc{URL: "/x"}); err != nil {
+		t.Errorf("expected no error, got %+v", err)
+	}
+
+	var started, completed int
+	for _, e := range events {
+		switch ev := e.(type) {
+		case DownloadStarted:
+			started++
+		case DownloadCompleted:
+			completed++
+			if e := int64(5); ev.BytesRead != e {
+				t.Errorf("expected %v, got %v", e, ev.BytesRead)
+			}
+		}
+	}
+	if e := 1; started != e {
+		t.Errorf("expected %v, got %v", e, started)
+	}
+	if e := 1; completed != e {
+		t.Errorf("expected %v, got %v", e, completed)
+	}
+
+	if s := d.Stats(); s.Successes != 1 || s.Failures != 0 || s.Bytes != 5 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
+
+func TestDownloadSegmented(t *testing.T) {
+	full := strings.Repeat("0123456789", 100)
+	client := mockedHTTPClient(func(req *http.Request) (resp *http.Response, err error) {
+		if req.Method == http.MethodHead {
+			resp = &http.Response{
+				StatusCode:    http.StatusOK,
+				ContentLength: int64(len(full)),
+				Header:        http.Header{"Accept-Ranges": []string{"bytes"}},
+				Body:          ioutil.NopCloser(bytes.NewReader(nil)),
+			}
+			return
+		}
+		var start, end int
+		rng := req.Header.Get("Range")
+		if _, e := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); e != nil {
+			t.Fatalf("unexpected range header %q", rng)
+		}
+		resp = &http.Response{
+			StatusCode: http.StatusPartialContent,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(full[start : end+1])),
+		}
+		return
+	})
+
+	d := NewHTTPDownloader(HTTPDownloaderOptions{
+		Limiter: GoroutineLimiterOptions{Max: 4},
+		Sender:  HTTPSenderOptions{Client: client},
+	})
+	defer d.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("creating temp dir failed: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Download in file, split in 4 segments
+	dst := filepath.Join(dir, "f")
+	if err = d.DownloadSegmented(context.Background(), dst, HTTPDownloaderSrc{URL: "/x"}, SegmentedOptions{Segments: 4, MinSegmentSize: 1}); err != nil {
+		t.Errorf("expected no error, got %+v", err)
+	}
+	checkFile(t, dst, full)
+
+	// Download in writer, split in 3 segments
+	w := &bytes.Buffer{}
+	if err = d.DownloadSegmented(context.Background(), w, HTTPDownloaderSrc{URL: "/x"}, SegmentedOptions{Segments: 3, MinSegmentSize: 1}); err != nil {
+		t.Errorf("expected no error, got %+v", err)
+	}
+	if e, g := full, w.String(); e != g {
+		t.Errorf("expected %s, got %s", e, g)
+	}
+}
+
+// A server that returns a 206 whose body is shorter than the requested range must fail the
+// segment rather than silently zero-filling/truncating the output
+func TestDownloadSegmentedShortSegment(t *testing.T) {
+	full := strings.Repeat("0123456789", 2)
+	client := mockedHTTPClient(func(req *http.Request) (resp *http.Response, err error) {
+		if req.Method == http.MethodHead {
+			resp = &http.Response{
+				StatusCode:    http.StatusOK,
+				ContentLength: int64(len(full)),
+				Header:        http.Header{"Accept-Ranges": []string{"bytes"}},
+				Body:          ioutil.NopCloser(bytes.NewReader(nil)),
+			}
+			return
+		}
+		var start, end int
+		rng := req.Header.Get("Range")
+		if _, e := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); e != nil {
+			t.Fatalf("unexpected range header %q", rng)
+		}
+		// Always returns 2 bytes, regardless of how many were actually requested
+		resp = &http.Response{
+			StatusCode: http.StatusPartialContent,
+			Body:       ioutil.NopCloser(bytes.NewBufferString(full[start : start+2])),
+		}
+		return
+	})
+
+	d := NewHTTPDownloader(HTTPDownloaderOptions{
+		Limiter: GoroutineLimiterOptions{Max: 4},
+		Sender:  HTTPSenderOptions{Client: client},
+	})
+	defer d.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("creating temp dir failed: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Download in file, split in 4 segments (5 bytes expected each)
+	dst := filepath.Join(dir, "f")
+	if err = d.DownloadSegmented(context.Background(), dst, HTTPDownloaderSrc{URL: "/x"}, SegmentedOptions{Segments: 4, MinSegmentSize: 1}); err == nil {
+		t.Error("expected error, got nil")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("expected %s not to exist, got err %+v", dst, err)
+	}
+
+	// Download in writer, split in 4 segments
+	w := &bytes.Buffer{}
+	if err = d.DownloadSegmented(context.Background(), w, HTTPDownloaderSrc{URL: "/x"}, SegmentedOptions{Segments: 4, MinSegmentSize: 1}); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
+// ExpectedSHA256 must be honored (or not) consistently, regardless of whether the server
+// supports ranges and the segmented path or the single-stream fallback ends up handling it
+func TestDownloadSegmentedSHA256Gating(t *testing.T) {
+	full := "hello world"
+	mismatchingSHA256 := strings.Repeat("0", 64)
+
+	newClient := func(supportsRanges bool) mockedHTTPClient {
+		return func(req *http.Request) (resp *http.Response, err error) {
+			if req.Method == http.MethodHead {
+				h := http.Header{}
+				if supportsRanges {
+					h.Set("Accept-Ranges", "bytes")
+				}
+				resp = &http.Response{StatusCode: http.StatusOK, ContentLength: int64(len(full)), Header: h, Body: ioutil.NopCloser(bytes.NewReader(nil))}
+				return
+			}
+			if supportsRanges {
+				var start, end int
+				fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+				resp = &http.Response{StatusCode: http.StatusPartialContent, Body: ioutil.NopCloser(bytes.NewBufferString(full[start : end+1]))}
+				return
+			}
+			resp = &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewBufferString(full))}
+			return
+		}
+	}
+
+	for _, supportsRanges := range []bool{true, false} {
+		supportsRanges := supportsRanges
+		t.Run(fmt.Sprintf("supportsRanges=%v", supportsRanges), func(t *testing.T) {
+			d := NewHTTPDownloader(HTTPDownloaderOptions{
+				Limiter: GoroutineLimiterOptions{Max: 2},
+				Sender:  HTTPSenderOptions{Client: newClient(supportsRanges)},
+			})
+			defer d.Close()
+
+			dir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatalf("creating temp dir failed: %+v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			// VerifySHA256 false: a mismatching ExpectedSHA256 is ignored either way
+			dst := filepath.Join(dir, "f")
+			src := HTTPDownloaderSrc{URL: "/x", ExpectedSHA256: mismatchingSHA256}
+			if err := d.DownloadSegmented(context.Background(), dst, src, SegmentedOptions{Segments: 2}); err != nil {
+				t.Errorf("expected no error, got %+v", err)
+			}
+
+			// VerifySHA256 true: the same mismatch must fail either way
+			dst = filepath.Join(dir, "g")
+			if err := d.DownloadSegmented(context.Background(), dst, src, SegmentedOptions{Segments: 2, VerifySHA256: true}); err == nil {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
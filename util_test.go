@@ -0,0 +1,17 @@
+package astikit
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+// checkFile reads the file at path and compares its content to expected
+func checkFile(t *testing.T, path, expected string) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %+v", err)
+	}
+	if e, g := expected, string(b); e != g {
+		t.Errorf("expected %s, got %s", e, g)
+	}
+}
@@ -0,0 +1,52 @@
+package astikit
+
+import (
+	"context"
+	"sync"
+)
+
+// WorkerOptions are Worker options
+type WorkerOptions struct{}
+
+// Worker tracks the lifecycle of a set of background tasks: Stop signals every listener of its
+// Context to wind down, and Wait blocks until they've all reported being Done.
+type Worker struct {
+	cancel context.CancelFunc
+	ctx    context.Context
+	wg     *sync.WaitGroup
+}
+
+// NewWorker creates a new Worker
+func NewWorker(o WorkerOptions) (w *Worker) {
+	w = &Worker{wg: &sync.WaitGroup{}}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	return
+}
+
+// Context returns the worker's context, canceled once Stop is called
+func (w *Worker) Context() context.Context { return w.ctx }
+
+// NewTask creates a new Task tracked by the worker. Wait won't return until every created Task
+// has been marked Done.
+func (w *Worker) NewTask() *Task {
+	w.wg.Add(1)
+	return &Task{o: &sync.Once{}, wg: w.wg}
+}
+
+// Stop cancels the worker's context
+func (w *Worker) Stop() { w.cancel() }
+
+// Wait blocks until the worker's context is done and every task created through NewTask is done
+func (w *Worker) Wait() {
+	<-w.ctx.Done()
+	w.wg.Wait()
+}
+
+// Task is a unit of work tracked by a Worker, created through Worker.NewTask
+type Task struct {
+	o  *sync.Once
+	wg *sync.WaitGroup
+}
+
+// Done marks the task as finished. Safe to call more than once.
+func (t *Task) Done() { t.o.Do(t.wg.Done) }